@@ -16,7 +16,23 @@ limitations under the License.
 package utils
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"gopkg.in/check.v1"
 )
@@ -35,3 +51,729 @@ func (s *ProxySuite) TearDownTest(c *check.C)  {}
 
 func (s *ProxySuite) TestProxyDial(c *check.C) {
 }
+
+// --- no_proxy bypass list ---
+
+func (s *ProxySuite) TestNoProxyExactHostAndSuffix(c *check.C) {
+	list := parseNoProxy("example.com,.internal.example.org")
+	c.Assert(list.matches("example.com"), check.Equals, true)
+	c.Assert(list.matches("EXAMPLE.COM"), check.Equals, true)
+	c.Assert(list.matches("foo.example.com"), check.Equals, true)
+	c.Assert(list.matches("host.internal.example.org"), check.Equals, true)
+	c.Assert(list.matches("other.com"), check.Equals, false)
+}
+
+func (s *ProxySuite) TestNoProxyIPAndCIDR(c *check.C) {
+	list := parseNoProxy("10.0.0.1,192.168.0.0/16")
+	c.Assert(list.matches("10.0.0.1"), check.Equals, true)
+	c.Assert(list.matches("10.0.0.2"), check.Equals, false)
+	c.Assert(list.matches("192.168.5.6"), check.Equals, true)
+	c.Assert(list.matches("172.16.0.1"), check.Equals, false)
+}
+
+func (s *ProxySuite) TestNoProxyWildcard(c *check.C) {
+	list := parseNoProxy("*")
+	c.Assert(list.matches("anything.example.com"), check.Equals, true)
+	c.Assert(list.matches("10.0.0.1"), check.Equals, true)
+}
+
+func (s *ProxySuite) TestNoProxyEmptyEntriesIgnored(c *check.C) {
+	list := parseNoProxy(" , ,example.com , ")
+	c.Assert(list.matches("example.com"), check.Equals, true)
+	c.Assert(list.matches("example.org"), check.Equals, false)
+}
+
+// --- SOCKS5/SOCKS4a handshakes ---
+
+// socks5ServerResult records what runSocks5Server was asked to CONNECT to.
+type socks5ServerResult struct {
+	addrType byte
+	dest     []byte
+	port     uint16
+}
+
+// runSocks5Server plays the server side of a SOCKS5 handshake over conn. It
+// offers the given auth method, optionally validates username/password
+// credentials, and replies to the CONNECT request with a success reply,
+// recording the address type and raw destination bytes it was asked to
+// connect to.
+func runSocks5Server(conn net.Conn, method byte, wantUser, wantPass string) (*socks5ServerResult, error) {
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{0x05, method}); err != nil {
+		return nil, err
+	}
+
+	if method == socks5AuthUsernamePass {
+		hdr := make([]byte, 2)
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			return nil, err
+		}
+		uname := make([]byte, hdr[1])
+		if _, err := io.ReadFull(conn, uname); err != nil {
+			return nil, err
+		}
+		plenBuf := make([]byte, 1)
+		if _, err := io.ReadFull(conn, plenBuf); err != nil {
+			return nil, err
+		}
+		passwd := make([]byte, plenBuf[0])
+		if _, err := io.ReadFull(conn, passwd); err != nil {
+			return nil, err
+		}
+		status := byte(0x00)
+		if string(uname) != wantUser || string(passwd) != wantPass {
+			status = 0x01
+		}
+		if _, err := conn.Write([]byte{0x01, status}); err != nil {
+			return nil, err
+		}
+		if status != 0x00 {
+			return nil, nil
+		}
+	}
+
+	reqHdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, reqHdr); err != nil {
+		return nil, err
+	}
+	result := &socks5ServerResult{addrType: reqHdr[3]}
+	switch reqHdr[3] {
+	case socks5AddrIPv4:
+		result.dest = make([]byte, net.IPv4len)
+	case socks5AddrIPv6:
+		result.dest = make([]byte, net.IPv6len)
+	case socks5AddrDomain:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return nil, err
+		}
+		result.dest = make([]byte, lenByte[0])
+	}
+	if len(result.dest) > 0 {
+		if _, err := io.ReadFull(conn, result.dest); err != nil {
+			return nil, err
+		}
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return nil, err
+	}
+	result.port = binary.BigEndian.Uint16(portBytes)
+
+	reply := []byte{0x05, 0x00, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0}
+	if _, err := conn.Write(reply); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *ProxySuite) TestSocks5NoAuthHandshake(c *check.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	resultCh := make(chan *socks5ServerResult, 1)
+	go func() {
+		result, err := runSocks5Server(server, socks5AuthNoAuth, "", "")
+		c.Check(err, check.IsNil)
+		resultCh <- result
+		server.Close()
+	}()
+
+	proxyURL := &url.URL{Scheme: "socks5h", Host: "proxy:1080"}
+	err := socks5Handshake(context.Background(), client, proxyURL, true, "example.com:443")
+	c.Assert(err, check.IsNil)
+
+	result := <-resultCh
+	c.Assert(result.addrType, check.Equals, byte(socks5AddrDomain))
+	c.Assert(string(result.dest), check.Equals, "example.com")
+	c.Assert(result.port, check.Equals, uint16(443))
+}
+
+func (s *ProxySuite) TestSocks5UserPassHandshake(c *check.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	resultCh := make(chan *socks5ServerResult, 1)
+	go func() {
+		result, err := runSocks5Server(server, socks5AuthUsernamePass, "alice", "hunter2")
+		c.Check(err, check.IsNil)
+		resultCh <- result
+		server.Close()
+	}()
+
+	proxyURL := &url.URL{Scheme: "socks5h", Host: "proxy:1080", User: url.UserPassword("alice", "hunter2")}
+	err := socks5Handshake(context.Background(), client, proxyURL, true, "example.com:22")
+	c.Assert(err, check.IsNil)
+
+	result := <-resultCh
+	c.Assert(result.addrType, check.Equals, byte(socks5AddrDomain))
+	c.Assert(string(result.dest), check.Equals, "example.com")
+}
+
+func (s *ProxySuite) TestSocks5UserPassHandshakeRejected(c *check.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		runSocks5Server(server, socks5AuthUsernamePass, "alice", "hunter2")
+		server.Close()
+	}()
+
+	proxyURL := &url.URL{Scheme: "socks5h", Host: "proxy:1080", User: url.UserPassword("alice", "wrong")}
+	err := socks5Handshake(context.Background(), client, proxyURL, true, "example.com:22")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *ProxySuite) TestSocks5ResolvesLocallyForPlainScheme(c *check.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	resultCh := make(chan *socks5ServerResult, 1)
+	go func() {
+		result, err := runSocks5Server(server, socks5AuthNoAuth, "", "")
+		c.Check(err, check.IsNil)
+		resultCh <- result
+		server.Close()
+	}()
+
+	// resolveOnProxy is false (plain "socks5"): the handshake should
+	// resolve "localhost" itself and send the proxy an IP address rather
+	// than the domain name.
+	proxyURL := &url.URL{Scheme: "socks5", Host: "proxy:1080"}
+	err := socks5Handshake(context.Background(), client, proxyURL, false, "localhost:443")
+	c.Assert(err, check.IsNil)
+
+	result := <-resultCh
+	c.Assert(result.addrType != socks5AddrDomain, check.Equals, true)
+}
+
+// When resolveOnProxy is true (the "h" variant), the destination is always
+// sent as a domain-name address, even when it is a literal IP, so that the
+// proxy does the lookup rather than the client.
+func (s *ProxySuite) TestSocks5UsesDomainAddressWhenResolveOnProxy(c *check.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	resultCh := make(chan *socks5ServerResult, 1)
+	go func() {
+		result, err := runSocks5Server(server, socks5AuthNoAuth, "", "")
+		c.Check(err, check.IsNil)
+		resultCh <- result
+		server.Close()
+	}()
+
+	proxyURL := &url.URL{Scheme: "socks5h", Host: "proxy:1080"}
+	err := socks5Handshake(context.Background(), client, proxyURL, true, "127.0.0.1:443")
+	c.Assert(err, check.IsNil)
+
+	result := <-resultCh
+	c.Assert(result.addrType, check.Equals, byte(socks5AddrDomain))
+	c.Assert(string(result.dest), check.Equals, "127.0.0.1")
+}
+
+// readNULTerminated reads a single NUL-terminated field off of conn, a byte
+// at a time, so it doesn't buffer ahead of bytes net.Pipe has not produced
+// yet.
+func readNULTerminated(conn net.Conn) ([]byte, error) {
+	var out []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil, err
+		}
+		if b[0] == 0x00 {
+			return out, nil
+		}
+		out = append(out, b[0])
+	}
+}
+
+func runSocks4aServer(conn net.Conn) (host string, port uint16, err error) {
+	hdr := make([]byte, 8)
+	if _, err = io.ReadFull(conn, hdr); err != nil {
+		return "", 0, err
+	}
+	port = binary.BigEndian.Uint16(hdr[2:4])
+
+	if _, err = readNULTerminated(conn); err != nil { // userid
+		return "", 0, err
+	}
+	domain, err := readNULTerminated(conn)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err = conn.Write([]byte{0x00, socks4Granted, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); err != nil {
+		return "", 0, err
+	}
+	return string(domain), port, nil
+}
+
+func (s *ProxySuite) TestSocks4aHandshake(c *check.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	type result struct {
+		host string
+		port uint16
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		host, port, err := runSocks4aServer(server)
+		c.Check(err, check.IsNil)
+		resultCh <- result{host: host, port: port}
+		server.Close()
+	}()
+
+	proxyURL := &url.URL{Scheme: "socks4a", Host: "proxy:1080"}
+	err := socks4Handshake(client, proxyURL, "example.com:8080")
+	c.Assert(err, check.IsNil)
+
+	r := <-resultCh
+	c.Assert(r.host, check.Equals, "example.com")
+	c.Assert(r.port, check.Equals, uint16(8080))
+}
+
+func (s *ProxySuite) TestSocks4aHandshakeRefused(c *check.C) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		hdr := make([]byte, 8)
+		io.ReadFull(server, hdr)
+		readNULTerminated(server)
+		readNULTerminated(server)
+		server.Write([]byte{0x00, 0x5b, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) // rejected
+		server.Close()
+	}()
+
+	proxyURL := &url.URL{Scheme: "socks4a", Host: "proxy:1080"}
+	err := socks4Handshake(client, proxyURL, "example.com:8080")
+	c.Assert(err, check.NotNil)
+}
+
+// --- ctx cancellation ---
+
+// blockingForward is a RawDialer whose DialContext succeeds immediately but
+// whose connections never produce a reply, so the caller's cancellation
+// path, rather than the protocol itself, is what unblocks the dial.
+type blockingForward struct {
+	conn net.Conn
+}
+
+func (f blockingForward) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return f.conn, nil
+}
+
+func (s *ProxySuite) TestSocksDialContextHonorsCancellation(c *check.C) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	raw := socksRaw{
+		proxyURL: &url.URL{Scheme: "socks5h", Host: "proxy:1080"},
+		forward:  blockingForward{conn: client},
+		version:  socks5,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := raw.DialContext(ctx, "tcp", "example.com:443")
+	c.Assert(err, check.NotNil)
+	c.Assert(errors.Is(err, context.Canceled), check.Equals, true)
+}
+
+// --- HTTP CONNECT proxy authentication ---
+
+func (s *ProxySuite) TestBasicAuthHeader(c *check.C) {
+	header := basicAuthHeader(url.UserPassword("alice", "hunter2"))
+	c.Assert(header, check.Equals, "Basic YWxpY2U6aHVudGVyMg==")
+}
+
+func (s *ProxySuite) TestSplitAuthChallenges(c *check.C) {
+	challenges := splitAuthChallenges(`Digest realm="proxy", nonce="abc", qop="auth"`)
+	c.Assert(challenges["digest"], check.Equals, `realm="proxy", nonce="abc", qop="auth"`)
+
+	challenges = splitAuthChallenges("Basic")
+	_, ok := challenges["basic"]
+	c.Assert(ok, check.Equals, true)
+	c.Assert(challenges["basic"], check.Equals, "")
+}
+
+func (s *ProxySuite) TestDigestAuthHeaderNoQop(c *check.C) {
+	header, err := digestAuthHeader(`realm="proxy", nonce="testnonce"`, url.UserPassword("alice", "hunter2"), "CONNECT", "example.com:443")
+	c.Assert(err, check.IsNil)
+	c.Assert(header, check.Matches, `Digest username="alice", realm="proxy", nonce="testnonce", uri="example.com:443", response="[0-9a-f]{32}"`)
+}
+
+func (s *ProxySuite) TestDigestAuthHeaderMissingNonce(c *check.C) {
+	_, err := digestAuthHeader(`realm="proxy"`, url.UserPassword("alice", "hunter2"), "CONNECT", "example.com:443")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *ProxySuite) TestProxyAuthHeaderFromChallengePrefersDigest(c *check.C) {
+	header, err := proxyAuthHeaderFromChallenge(
+		`Basic realm="proxy", Digest realm="proxy", nonce="testnonce"`,
+		url.UserPassword("alice", "hunter2"), "CONNECT", "example.com:443")
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.HasPrefix(header, "Digest "), check.Equals, true)
+}
+
+func (s *ProxySuite) TestProxyAuthHeaderFromChallengeFallsBackToBasic(c *check.C) {
+	header, err := proxyAuthHeaderFromChallenge(`Basic realm="proxy"`, url.UserPassword("alice", "hunter2"), "CONNECT", "example.com:443")
+	c.Assert(err, check.IsNil)
+	c.Assert(header, check.Equals, "Basic YWxpY2U6aHVudGVyMg==")
+}
+
+func (s *ProxySuite) TestProxyAuthHeaderFromChallengeUnsupportedScheme(c *check.C) {
+	_, err := proxyAuthHeaderFromChallenge("NTLM", url.UserPassword("alice", "hunter2"), "CONNECT", "example.com:443")
+	c.Assert(err, check.NotNil)
+}
+
+// challengeProxyResult reports the Proxy-Authorization header the retried
+// CONNECT request carried, or the error encountered serving it.
+type challengeProxyResult struct {
+	authHeader string
+	err        error
+}
+
+// runConnectChallengeProxy accepts exactly two CONNECT connections on ln: it
+// rejects the first with a 407 and the given Proxy-Authenticate challenge,
+// closing the connection, then accepts the second, replies 200, and reports
+// the Proxy-Authorization header it was retried with. This exercises the
+// real re-dial-and-retry path in httpConnectRaw.DialContext, not just the
+// header builders.
+func runConnectChallengeProxy(ln net.Listener, challenge string) <-chan challengeProxyResult {
+	resultCh := make(chan challengeProxyResult, 1)
+	go func() {
+		conn1, err := ln.Accept()
+		if err != nil {
+			resultCh <- challengeProxyResult{err: err}
+			return
+		}
+		if _, err := http.ReadRequest(bufio.NewReader(conn1)); err != nil {
+			conn1.Close()
+			resultCh <- challengeProxyResult{err: err}
+			return
+		}
+		resp := &http.Response{
+			Status:     "407 Proxy Authentication Required",
+			StatusCode: http.StatusProxyAuthRequired,
+			Header:     http.Header{"Proxy-Authenticate": []string{challenge}},
+		}
+		resp.Write(conn1)
+		conn1.Close()
+
+		conn2, err := ln.Accept()
+		if err != nil {
+			resultCh <- challengeProxyResult{err: err}
+			return
+		}
+		defer conn2.Close()
+		req2, err := http.ReadRequest(bufio.NewReader(conn2))
+		if err != nil {
+			resultCh <- challengeProxyResult{err: err}
+			return
+		}
+		resp2 := &http.Response{Status: "200 OK", StatusCode: 200}
+		resp2.Write(conn2)
+		resultCh <- challengeProxyResult{authHeader: req2.Header.Get("Proxy-Authorization")}
+	}()
+	return resultCh
+}
+
+func (s *ProxySuite) TestHTTPConnectRetriesWithBasicCredentialsOn407(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+
+	resultCh := runConnectChallengeProxy(ln, `Basic realm="proxy"`)
+
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String(), User: url.UserPassword("alice", "hunter2")}
+	raw := httpConnectRaw{proxyURL: proxyURL, forward: directRaw{}}
+
+	conn, err := raw.DialContext(context.Background(), "tcp", "example.com:443")
+	c.Assert(err, check.IsNil)
+	conn.Close()
+
+	result := <-resultCh
+	c.Assert(result.err, check.IsNil)
+	c.Assert(result.authHeader, check.Equals, "Basic YWxpY2U6aHVudGVyMg==")
+}
+
+func (s *ProxySuite) TestHTTPConnectRetriesWithDigestCredentialsOn407(c *check.C) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+
+	challenge := `Digest realm="proxy", nonce="testnonce"`
+	resultCh := runConnectChallengeProxy(ln, challenge)
+
+	proxyURL := &url.URL{Scheme: "http", Host: ln.Addr().String(), User: url.UserPassword("alice", "hunter2")}
+	raw := httpConnectRaw{proxyURL: proxyURL, forward: directRaw{}}
+
+	conn, err := raw.DialContext(context.Background(), "tcp", "example.com:443")
+	c.Assert(err, check.IsNil)
+	conn.Close()
+
+	result := <-resultCh
+	c.Assert(result.err, check.IsNil)
+
+	wantHeader, err := digestAuthHeader(`realm="proxy", nonce="testnonce"`, url.UserPassword("alice", "hunter2"), "CONNECT", "example.com:443")
+	c.Assert(err, check.IsNil)
+	c.Assert(result.authHeader, check.Equals, wantHeader)
+}
+
+// --- TLS-wrapped CONNECT proxy ---
+
+// generateSelfSignedCert creates an in-memory self-signed certificate valid
+// for the IP 127.0.0.1, for use by a loopback TLS-terminating CONNECT
+// proxy in tests.
+func generateSelfSignedCert() (tls.Certificate, *x509.Certificate, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, leaf, nil
+}
+
+func (s *ProxySuite) TestHTTPSConnectFailsCertVerificationByDefault(c *check.C) {
+	cert, _, err := generateSelfSignedCert()
+	c.Assert(err, check.IsNil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	tlsLn := tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+	go func() {
+		conn, err := tlsLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+	}()
+
+	proxyURL := &url.URL{Scheme: "https", Host: ln.Addr().String()}
+	raw := httpConnectRaw{proxyURL: proxyURL, forward: directRaw{}}
+
+	_, err = raw.DialContext(context.Background(), "tcp", "example.com:443")
+	c.Assert(err, check.NotNil)
+}
+
+func (s *ProxySuite) TestHTTPSConnectAppliesTLSConfigOverride(c *check.C) {
+	cert, leaf, err := generateSelfSignedCert()
+	c.Assert(err, check.IsNil)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer ln.Close()
+	tlsLn := tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	resultCh := make(chan error, 1)
+	go func() {
+		conn, err := tlsLn.Accept()
+		if err != nil {
+			resultCh <- err
+			return
+		}
+		defer conn.Close()
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			resultCh <- err
+			return
+		}
+		resp := &http.Response{Status: "200 OK", StatusCode: 200}
+		resp.Write(conn)
+		resultCh <- nil
+	}()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+
+	proxyURL := &url.URL{Scheme: "https", Host: ln.Addr().String()}
+	raw := httpConnectRaw{
+		proxyURL:  proxyURL,
+		forward:   directRaw{},
+		tlsConfig: &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"},
+	}
+
+	conn, err := raw.DialContext(context.Background(), "tcp", "example.com:443")
+	c.Assert(err, check.IsNil)
+	conn.Close()
+	c.Assert(<-resultCh, check.IsNil)
+}
+
+func (s *ProxySuite) TestDialerFromConfigAppliesTLSConfigOverride(c *check.C) {
+	override := &tls.Config{InsecureSkipVerify: true}
+	dialer, err := DialerFromConfig(ProxyConfig{ProxyURL: "https://proxy.example.com:443", TLSConfig: override})
+	c.Assert(err, check.IsNil)
+
+	sshDialer, ok := dialer.(rawSSHDialer)
+	c.Assert(ok, check.Equals, true)
+	httpRaw, ok := sshDialer.raw.(httpConnectRaw)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(httpRaw.tlsConfig, check.Equals, override)
+}
+
+// --- dialer registry: FromURL, RegisterDialerType, ChainDialers ---
+
+func (s *ProxySuite) TestFromURLDispatchesByScheme(c *check.C) {
+	for _, scheme := range []string{"http", "https", "socks5", "socks5h", "socks4a"} {
+		dialer, err := FromURL(&url.URL{Scheme: scheme, Host: "proxy:1080"})
+		c.Assert(err, check.IsNil)
+		sshDialer, ok := dialer.(rawSSHDialer)
+		c.Assert(ok, check.Equals, true)
+
+		switch scheme {
+		case "http", "https":
+			_, ok := sshDialer.raw.(httpConnectRaw)
+			c.Assert(ok, check.Equals, true)
+		default:
+			_, ok := sshDialer.raw.(socksRaw)
+			c.Assert(ok, check.Equals, true)
+		}
+	}
+}
+
+func (s *ProxySuite) TestFromURLUnregisteredSchemeFails(c *check.C) {
+	_, err := FromURL(&url.URL{Scheme: "ftp", Host: "proxy:21"})
+	c.Assert(err, check.NotNil)
+}
+
+// fakeRegisteredRawDialer is a trivial RawDialer used to prove that
+// RegisterDialerType's factory is actually consulted by FromURL, without
+// needing a real network implementation.
+type fakeRegisteredRawDialer struct{}
+
+func (fakeRegisteredRawDialer) DialContext(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return nil, errors.New("fakeRegisteredRawDialer should never be dialed in this test")
+}
+
+func (s *ProxySuite) TestRegisterDialerTypeCustomScheme(c *check.C) {
+	RegisterDialerType("x-test-scheme", func(proxyURL *url.URL, forward RawDialer) (RawDialer, error) {
+		return fakeRegisteredRawDialer{}, nil
+	})
+
+	dialer, err := FromURL(&url.URL{Scheme: "x-test-scheme", Host: "proxy:1"})
+	c.Assert(err, check.IsNil)
+
+	sshDialer, ok := dialer.(rawSSHDialer)
+	c.Assert(ok, check.Equals, true)
+	_, ok = sshDialer.raw.(fakeRegisteredRawDialer)
+	c.Assert(ok, check.Equals, true)
+}
+
+// runConnectProxy accepts a single CONNECT request on ln, reports the
+// requested target on targetCh, and then tunnels raw bytes between the
+// client and a real dial to that target, the same way ConnectHandler does.
+func runConnectProxy(ln net.Listener, targetCh chan<- string) {
+	go func() {
+		sconn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(sconn))
+		if err != nil {
+			sconn.Close()
+			return
+		}
+		targetCh <- req.Host
+
+		dconn, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			sconn.Close()
+			return
+		}
+
+		resp := &http.Response{Status: "200 OK", StatusCode: 200}
+		resp.Write(sconn)
+
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(sconn, dconn)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(dconn, sconn)
+			done <- struct{}{}
+		}()
+		<-done
+		<-done
+		sconn.Close()
+		dconn.Close()
+	}()
+}
+
+func (s *ProxySuite) TestChainDialersTunnelsThroughEachHopInOrder(c *check.C) {
+	finalLn, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer finalLn.Close()
+	go func() {
+		conn, err := finalLn.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("hello-from-final-hop"))
+	}()
+
+	hop2Ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer hop2Ln.Close()
+	hop2TargetCh := make(chan string, 1)
+	runConnectProxy(hop2Ln, hop2TargetCh)
+
+	hop1Ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	defer hop1Ln.Close()
+	hop1TargetCh := make(chan string, 1)
+	runConnectProxy(hop1Ln, hop1TargetCh)
+
+	dialer, err := ChainDialers("http://"+hop1Ln.Addr().String(), "http://"+hop2Ln.Addr().String())
+	c.Assert(err, check.IsNil)
+	sshDialer, ok := dialer.(rawSSHDialer)
+	c.Assert(ok, check.Equals, true)
+
+	conn, err := sshDialer.raw.DialContext(context.Background(), "tcp", finalLn.Addr().String())
+	c.Assert(err, check.IsNil)
+	defer conn.Close()
+
+	buf := make([]byte, len("hello-from-final-hop"))
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(buf), check.Equals, "hello-from-final-hop")
+
+	// hop1 is dialed directly by the chain and is asked to CONNECT to
+	// hop2's address...
+	c.Assert(<-hop1TargetCh, check.Equals, hop2Ln.Addr().String())
+	// ...while hop2 only ever sees a request for the final destination,
+	// proving it is reached through hop1 rather than directly.
+	c.Assert(<-hop2TargetCh, check.Equals, finalLn.Addr().String())
+}